@@ -44,7 +44,6 @@ import (
 	"github.com/vectorizedio/redpanda/src/go/rpk/pkg/config"
 	"github.com/vectorizedio/redpanda/src/go/rpk/pkg/kafka"
 	"github.com/vectorizedio/redpanda/src/go/rpk/pkg/out"
-	"github.com/vectorizedio/redpanda/src/go/rpk/pkg/system"
 	"github.com/vectorizedio/redpanda/src/go/rpk/pkg/system/syslog"
 	"gopkg.in/yaml.v2"
 )
@@ -52,13 +51,13 @@ import (
 // Use the same date specs as journalctl (see `man journalctl`).
 const timeHelpText = `(journalctl date format, e.g. YYYY-MM-DD)`
 
-type step func() error
-
 type stepParams struct {
-	fs      afero.Fs
-	m       sync.Mutex
-	w       *zip.Writer
-	timeout time.Duration
+	fs              afero.Fs
+	m               sync.Mutex
+	w               *zip.Writer
+	timeout         time.Duration
+	metricsInterval time.Duration
+	metricsDuration time.Duration
 }
 
 type fileInfo struct {
@@ -133,7 +132,13 @@ func writeCommandOutputToZipLimit(
 		return err
 	}
 
-	if outputLimitBytes > 0 {
+	switch {
+	case outputLimitBytes == 0:
+		// A limit of exactly zero means "write nothing", e.g. a shared
+		// budget across several files that's already exhausted. This is
+		// distinct from a negative limit, which means unlimited.
+		return nil
+	case outputLimitBytes > 0:
 		wr = &limitedWriter{
 			w:          wr,
 			limitBytes: outputLimitBytes,
@@ -194,6 +199,20 @@ func NewBundleCommand(fs afero.Fs) *cobra.Command {
 		logsUntil     string
 		logsSizeLimit string
 
+		namespace   string
+		kubeContext string
+
+		metricsInterval time.Duration
+		metricsDuration time.Duration
+
+		include []string
+		exclude []string
+		only    []string
+
+		uploadURL     string
+		uploadHeaders []string
+		uploadOnly    bool
+
 		timeout time.Duration
 	)
 	command := &cobra.Command{
@@ -217,8 +236,9 @@ The following are the data sources that are bundled in the compressed file:
 
  - /proc/interrupts: IRQ distribution across CPU cores.
 
- - Resource usage data: CPU usage percentage, free memory available for the
-   redpanda process.
+ - Resource usage data: A time series of the redpanda process's CPU usage,
+   memory (RSS, anon, file and PSS), disk IO, open file descriptor count and
+   thread count, sampled every --metrics-interval over --metrics-duration.
 
  - Clock drift: The ntp clock delta (using pool.ntp.org as a reference) & round
    trip time.
@@ -235,7 +255,13 @@ The following are the data sources that are bundled in the compressed file:
 
  - redpanda logs: The redpanda logs written to journald. If --logs-since or
    --logs-until are passed, then only the logs within the resulting time frame
-   will be included.
+   will be included. If there's no 'redpanda' journald unit - the common case
+   inside a container - this falls back, in order, to: pod/container log
+   files under /var/log/pods and /var/log/containers, a reachable container
+   runtime socket (docker or containerd), and $RPK_LOG_PATH. --logs-size-limit
+   caps each individual log file collected this way, and the fallback's total
+   output across every matching container is additionally capped at 5x that
+   limit.
 
  - Socket info: The active sockets data output by 'ss'.
 
@@ -249,6 +275,27 @@ The following are the data sources that are bundled in the compressed file:
 
  - dmidecode: The DMI table contents. Only included if this command is run
    as root.
+
+When this command runs inside a Kubernetes Pod, it additionally collects the
+owning Pod's spec, events, per-container logs (current and previous), the
+owning StatefulSet/DaemonSet, the referenced ConfigMaps/Secrets (redacted),
+and a description of the node hosting the Pod, all fetched through the
+Kubernetes API using the Pod's own service account. --namespace and
+--kube-context can be used to target a different namespace or kubectl
+context. If the API server can't be reached, this falls back to the regular
+journald-based log collection.
+
+By default every collector above runs. --only, --include and --exclude
+accept comma-separated collector names, categories (kafka, system, os,
+network, kubernetes), or glob patterns, to run a subset instead; run 'rpk
+debug bundle list-collectors' to see what's available.
+
+--upload-url optionally uploads the resulting bundle to S3, GCS, or an
+HTTPS endpoint once it's created, printing the resulting URL and ETag to
+stdout. --upload-only deletes the local copy once the upload succeeds. The
+s3:// and gs:// targets shell out to the 'aws' and 'gsutil' CLIs
+respectively, which must be on PATH and already configured with
+credentials.
 `,
 		SilenceUsage: true,
 		Run: func(cmd *cobra.Command, args []string) {
@@ -256,18 +303,60 @@ The following are the data sources that are bundled in the compressed file:
 			cfg, err := p.Load(fs)
 			out.MaybeDie(err, "unable to load config: %v", err)
 
-			admin, err := admin.NewClient(fs, cfg)
-			out.MaybeDie(err, "unable to initialize admin client: %v", err)
+			// The admin and Kafka clients are only constructed, at most
+			// once, if a selected collector actually asks for one -
+			// otherwise a run scoped with --only/--include/--exclude to
+			// collectors that don't need them (e.g. --only logs) doesn't
+			// fail just because the broker being debugged is unreachable.
+			var (
+				adminOnce   sync.Once
+				adminClient *admin.AdminAPI
+				adminErr    error
+			)
+			getAdminClient := func() (*admin.AdminAPI, error) {
+				adminOnce.Do(func() {
+					adminClient, adminErr = admin.NewClient(fs, cfg)
+				})
+				return adminClient, adminErr
+			}
 
-			cl, err := kafka.NewFranzClient(fs, p, cfg)
-			out.MaybeDie(err, "unable to initialize kafka client: %v", err)
-			defer cl.Close()
+			var (
+				kafkaOnce   sync.Once
+				kafkaClient *kgo.Client
+				kafkaErr    error
+			)
+			getKafkaClient := func() (*kgo.Client, error) {
+				kafkaOnce.Do(func() {
+					kafkaClient, kafkaErr = kafka.NewFranzClient(fs, p, cfg)
+				})
+				return kafkaClient, kafkaErr
+			}
+			defer func() {
+				if kafkaClient != nil {
+					kafkaClient.Close()
+				}
+			}()
 
 			logsLimit, err := units.FromHumanSize(logsSizeLimit)
 			out.MaybeDie(err, "unable to parse --logs-size-limit: %v", err)
 
-			err = executeBundle(fs, cfg, cl, admin, logsSince, logsUntil, int(logsLimit), timeout)
+			filename, err := executeBundle(fs, cfg, getKafkaClient, getAdminClient, logsSince, logsUntil, int(logsLimit), namespace, kubeContext, metricsInterval, metricsDuration, include, exclude, only, timeout)
 			out.MaybeDie(err, "unable to create bundle: %v", err)
+
+			if uploadURL != "" {
+				headers, err := parseUploadHeaders(uploadHeaders)
+				out.MaybeDie(err, "%v", err)
+
+				result, err := uploadBundle(fs, filename, uploadURL, headers, timeout)
+				out.MaybeDie(err, "unable to upload bundle: %v", err)
+
+				fmt.Printf("%s\t%s\n", result.URL, result.ETag)
+
+				if uploadOnly {
+					err := fs.Remove(filename)
+					out.MaybeDie(err, "unable to remove local bundle '%s' after upload: %v", filename, err)
+				}
+			}
 		},
 	}
 	command.Flags().StringVar(
@@ -298,8 +387,71 @@ The following are the data sources that are bundled in the compressed file:
 		&logsSizeLimit,
 		"logs-size-limit",
 		"100MiB",
-		"Read the logs until the given size is reached. Multipliers are also supported, e.g. 3MB, 1GiB.",
+		"Read the logs until the given size is reached, per file. Multipliers are also supported, e.g. 3MB, 1GiB. "+
+			"When collecting logs for multiple containers, the total across all of them is additionally capped at 5x this limit.",
 	)
+	command.Flags().StringVar(
+		&namespace,
+		"namespace",
+		"",
+		"The Kubernetes namespace to use when this is running inside a Kubernetes Pod. Defaults to the Pod's own namespace.",
+	)
+	command.Flags().StringVar(
+		&kubeContext,
+		"kube-context",
+		"",
+		"The kubectl context to use for commands that require it (e.g. describing the node), when this is running inside a Kubernetes Pod.",
+	)
+	command.Flags().DurationVar(
+		&metricsInterval,
+		"metrics-interval",
+		time.Second,
+		"The frequency at which resource usage metrics are sampled.",
+	)
+	command.Flags().DurationVar(
+		&metricsDuration,
+		"metrics-duration",
+		30*time.Second,
+		"How long to sample resource usage metrics for.",
+	)
+	command.Flags().StringSliceVar(
+		&only,
+		"only",
+		nil,
+		"Comma-separated list of collector names, categories, or glob patterns to run, to the exclusion of all others (e.g. 'kafka-*,logs'). See 'rpk debug bundle list-collectors'.",
+	)
+	command.Flags().StringSliceVar(
+		&include,
+		"include",
+		nil,
+		"Comma-separated list of collector names, categories, or glob patterns to run in addition to --only/--exclude's selection.",
+	)
+	command.Flags().StringSliceVar(
+		&exclude,
+		"exclude",
+		nil,
+		"Comma-separated list of collector names, categories, or glob patterns to skip.",
+	)
+	command.Flags().StringVar(
+		&uploadURL,
+		"upload-url",
+		"",
+		"If set, upload the bundle to this URL once it's created. Supports s3://bucket/key (via the 'aws' CLI), gs://bucket/key (via 'gsutil') and https://host/path (PUT) targets.",
+	)
+	command.Flags().StringArrayVar(
+		&uploadHeaders,
+		"upload-header",
+		nil,
+		"A 'key=value' HTTP header to send with an https:// --upload-url (e.g. for a bearer token). Can be passed multiple times.",
+	)
+	command.Flags().BoolVar(
+		&uploadOnly,
+		"upload-only",
+		false,
+		"Delete the local bundle file once it's been uploaded successfully. Requires --upload-url.",
+	)
+
+	command.AddCommand(newListCollectorsCommand())
 
 	common.AddKafkaFlags(
 		command,
@@ -323,15 +475,33 @@ The following are the data sources that are bundled in the compressed file:
 	return command
 }
 
+// newListCollectorsCommand prints every collector registered for
+// 'rpk debug bundle', along with its category, so that users can build
+// --include/--exclude/--only selections.
+func newListCollectorsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:          "list-collectors",
+		Short:        "List the collectors available to 'rpk debug bundle'.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		Run: func(*cobra.Command, []string) {
+			fmt.Print(formatCollectorList(collectors))
+		},
+	}
+}
+
 func executeBundle(
 	fs afero.Fs,
 	conf *config.Config,
-	cl *kgo.Client,
-	admin *admin.AdminAPI,
+	getKafkaClient func() (*kgo.Client, error),
+	getAdminClient func() (*admin.AdminAPI, error),
 	logsSince, logsUntil string,
 	logsLimitBytes int,
+	namespace, kubeContext string,
+	metricsInterval, metricsDuration time.Duration,
+	include, exclude, only []string,
 	timeout time.Duration,
-) error {
+) (string, error) {
 	mode := os.FileMode(0755)
 	timestamp := time.Now().Unix()
 	filename := fmt.Sprintf("%d-bundle.zip", timestamp)
@@ -341,7 +511,7 @@ func executeBundle(
 		mode,
 	)
 	if err != nil {
-		return fmt.Errorf("couldn't create bundle file: %w", err)
+		return "", fmt.Errorf("couldn't create bundle file: %w", err)
 	}
 	defer f.Close()
 
@@ -351,35 +521,47 @@ func executeBundle(
 	defer w.Close()
 
 	ps := &stepParams{
-		fs:      fs,
-		w:       w,
-		timeout: timeout,
-	}
-
-	steps := []step{
-		saveKafkaMetadata(ps, cl),
-		saveDataDirStructure(ps, conf),
-		saveConfig(ps, conf),
-		saveCPUInfo(ps),
-		saveInterrupts(ps),
-		saveResourceUsageData(ps, conf),
-		saveNTPDrift(ps),
-		saveSyslog(ps),
-		savePrometheusMetrics(ps, admin),
-		saveDNSData(ps),
-		saveDiskUsage(ps, conf),
-		saveLogs(ps, logsSince, logsUntil, logsLimitBytes),
-		saveSocketData(ps),
-		saveTopOutput(ps),
-		saveVmstat(ps),
-		saveIp(ps),
-		saveLspci(ps),
-		saveDmidecode(ps),
-	}
-
-	for _, s := range steps {
+		fs:              fs,
+		w:               w,
+		timeout:         timeout,
+		metricsInterval: metricsInterval,
+		metricsDuration: metricsDuration,
+	}
+
+	var (
+		k8sOnce sync.Once
+		k8sInfo *k8sBundleInfo
+	)
+	getK8sInfo := func() *k8sBundleInfo {
+		k8sOnce.Do(func() {
+			if runningInKubernetes(fs) {
+				k8sInfo = detectKubernetesBundleInfo(ps, namespace, kubeContext)
+			}
+		})
+		return k8sInfo
+	}
+
+	b := &BundleCtx{
+		ps:             ps,
+		conf:           conf,
+		kafkaClient:    getKafkaClient,
+		adminClient:    getAdminClient,
+		logsSince:      logsSince,
+		logsUntil:      logsUntil,
+		logsLimitBytes: logsLimitBytes,
+		k8s:            getK8sInfo,
+	}
+
+	var names []string
+	for _, c := range selectCollectors(collectors, only, include, exclude) {
+		s := c.build(b)
+		if s == nil {
+			continue
+		}
+		names = append(names, c.name)
 		grp.Go(s)
 	}
+	log.Debugf("running collectors: %s", strings.Join(names, ", "))
 
 	errs := grp.Wait()
 	if errs != nil {
@@ -391,7 +573,7 @@ func executeBundle(
 	}
 
 	log.Infof("Debug bundle saved to '%s'", filename)
-	return nil
+	return filename, nil
 }
 
 // Parses an error return from kadm, and if the return is a shard errors,
@@ -423,7 +605,7 @@ func stringifyKadmErr(err error) []string {
 	}
 }
 
-func saveKafkaMetadata(ps *stepParams, cl *kgo.Client) step {
+func saveKafkaMetadata(ps *stepParams, cl *kgo.Client) Step {
 	return func() error {
 		log.Debug("Reading Kafka information")
 
@@ -511,7 +693,7 @@ func saveKafkaMetadata(ps *stepParams, cl *kgo.Client) step {
 // objects containing their data: size, mode, the file or dir it points to
 // if the current file is a symlink, the time it was modified, its owner and
 // its group, as well as an error message if reading that specific file failed.
-func saveDataDirStructure(ps *stepParams, conf *config.Config) step {
+func saveDataDirStructure(ps *stepParams, conf *config.Config) Step {
 	return func() error {
 		files := make(map[string]*fileInfo)
 		err := walkDir(conf.Redpanda.Directory, files)
@@ -531,7 +713,7 @@ func saveDataDirStructure(ps *stepParams, conf *config.Config) step {
 }
 
 // Writes the config file to the bundle, redacting SASL credentials.
-func saveConfig(ps *stepParams, conf *config.Config) step {
+func saveConfig(ps *stepParams, conf *config.Config) Step {
 	return func() error {
 		// Redact SASL credentials
 		redacted := "(REDACTED)"
@@ -552,7 +734,7 @@ func saveConfig(ps *stepParams, conf *config.Config) step {
 }
 
 // Saves the contents of /proc/cpuinfo
-func saveCPUInfo(ps *stepParams) step {
+func saveCPUInfo(ps *stepParams) Step {
 	return func() error {
 		bs, err := afero.ReadFile(ps.fs, "/proc/cpuinfo")
 		if err != nil {
@@ -563,7 +745,7 @@ func saveCPUInfo(ps *stepParams) step {
 }
 
 // Saves the contents of /proc/interrupts
-func saveInterrupts(ps *stepParams) step {
+func saveInterrupts(ps *stepParams) Step {
 	return func() error {
 		bs, err := afero.ReadFile(ps.fs, "/proc/interrupts")
 		if err != nil {
@@ -573,27 +755,8 @@ func saveInterrupts(ps *stepParams) step {
 	}
 }
 
-// Writes a file containing memory, disk & CPU usage metrics for a local
-// redpanda process.
-func saveResourceUsageData(ps *stepParams, conf *config.Config) step {
-	return func() error {
-		res, err := system.GatherMetrics(ps.fs, ps.timeout, *conf)
-		if system.IsErrRedpandaDown(err) {
-			return fmt.Errorf("omitting resource usage metrics: %w", err)
-		}
-		if err != nil {
-			return fmt.Errorf("error gathering resource usage metrics: %w", err)
-		}
-		bs, err := json.Marshal(res)
-		if err != nil {
-			return fmt.Errorf("couldn't encode resource usage metrics: %w", err)
-		}
-		return writeFileToZip(ps, "resource-usage.json", bs)
-	}
-}
-
 // Queries 'pool.ntp.org' and writes a file with the reported RTT, time & precision.
-func saveNTPDrift(ps *stepParams) step {
+func saveNTPDrift(ps *stepParams) Step {
 	return func() error {
 		const host = "pool.ntp.org"
 
@@ -627,7 +790,7 @@ func saveNTPDrift(ps *stepParams) step {
 	}
 }
 
-func saveSyslog(ps *stepParams) step {
+func saveSyslog(ps *stepParams) Step {
 	return func() error {
 		entries, err := syslog.ReadAll()
 		if err != nil {
@@ -638,7 +801,7 @@ func saveSyslog(ps *stepParams) step {
 }
 
 // Queries the given admin API address for prometheus metrics.
-func savePrometheusMetrics(ps *stepParams, admin *admin.AdminAPI) step {
+func savePrometheusMetrics(ps *stepParams, admin *admin.AdminAPI) Step {
 	return func() error {
 		raw, err := admin.PrometheusMetrics()
 		if err != nil {
@@ -649,14 +812,14 @@ func savePrometheusMetrics(ps *stepParams, admin *admin.AdminAPI) step {
 }
 
 // Saves the output of `dig`
-func saveDNSData(ps *stepParams) step {
+func saveDNSData(ps *stepParams) Step {
 	return func() error {
 		return writeCommandOutputToZip(ps, "dig.txt", "dig")
 	}
 }
 
 // Saves the disk usage total within redpanda's data directory.
-func saveDiskUsage(ps *stepParams, conf *config.Config) step {
+func saveDiskUsage(ps *stepParams, conf *config.Config) Step {
 	return func() error {
 		return writeCommandOutputToZip(
 			ps,
@@ -666,36 +829,15 @@ func saveDiskUsage(ps *stepParams, conf *config.Config) step {
 	}
 }
 
-// TODO: What if running inside a container/ k8s?
-// Writes the journald redpanda logs, if available, to the bundle.
-func saveLogs(ps *stepParams, since, until string, logsLimitBytes int) step {
-	return func() error {
-		args := []string{"--no-pager", "-u", "redpanda"}
-		if since != "" {
-			args = append(args, "--since", since)
-		}
-		if until != "" {
-			args = append(args, "--until", until)
-		}
-		return writeCommandOutputToZipLimit(
-			ps,
-			"redpanda.log",
-			logsLimitBytes,
-			"journalctl",
-			args...,
-		)
-	}
-}
-
 // Saves the output of `ss`
-func saveSocketData(ps *stepParams) step {
+func saveSocketData(ps *stepParams) Step {
 	return func() error {
 		return writeCommandOutputToZip(ps, "ss.txt", "ss")
 	}
 }
 
 // Saves the output of `top`
-func saveTopOutput(ps *stepParams) step {
+func saveTopOutput(ps *stepParams) Step {
 	return func() error {
 		return writeCommandOutputToZip(
 			ps,
@@ -706,7 +848,7 @@ func saveTopOutput(ps *stepParams) step {
 }
 
 // Saves the output of `vmstat`
-func saveVmstat(ps *stepParams) step {
+func saveVmstat(ps *stepParams) Step {
 	return func() error {
 		return writeCommandOutputToZip(
 			ps,
@@ -717,7 +859,7 @@ func saveVmstat(ps *stepParams) step {
 }
 
 // Saves the output of `ip addr`
-func saveIp(ps *stepParams) step {
+func saveIp(ps *stepParams) Step {
 	return func() error {
 		return writeCommandOutputToZip(
 			ps,
@@ -728,7 +870,7 @@ func saveIp(ps *stepParams) step {
 }
 
 // Saves the output of `lspci`
-func saveLspci(ps *stepParams) step {
+func saveLspci(ps *stepParams) Step {
 	return func() error {
 		return writeCommandOutputToZip(
 			ps,
@@ -739,7 +881,7 @@ func saveLspci(ps *stepParams) step {
 }
 
 // Saves the output of `dmidecode`
-func saveDmidecode(ps *stepParams) step {
+func saveDmidecode(ps *stepParams) Step {
 	return func() error {
 		return writeCommandOutputToZip(
 			ps,
@@ -828,3 +970,72 @@ func walkDir(root string, files map[string]*fileInfo) error {
 		},
 	)
 }
+
+func init() {
+	RegisterCollector("kafka-metadata", CategoryKafka, func(b *BundleCtx) Step {
+		return func() error {
+			cl, err := b.kafkaClient()
+			if err != nil {
+				return fmt.Errorf("unable to initialize the kafka client: %w", err)
+			}
+			return saveKafkaMetadata(b.ps, cl)()
+		}
+	})
+	RegisterCollector("data-dir", CategoryOS, func(b *BundleCtx) Step {
+		return saveDataDirStructure(b.ps, b.conf)
+	})
+	RegisterCollector("config", CategoryOS, func(b *BundleCtx) Step {
+		return saveConfig(b.ps, b.conf)
+	})
+	RegisterCollector("cpu-info", CategorySystem, func(b *BundleCtx) Step {
+		return saveCPUInfo(b.ps)
+	})
+	RegisterCollector("interrupts", CategorySystem, func(b *BundleCtx) Step {
+		return saveInterrupts(b.ps)
+	})
+	RegisterCollector("resource-usage", CategorySystem, func(b *BundleCtx) Step {
+		return saveResourceUsageData(b.ps, b.conf)
+	})
+	RegisterCollector("ntp-drift", CategorySystem, func(b *BundleCtx) Step {
+		return saveNTPDrift(b.ps)
+	})
+	RegisterCollector("syslog", CategoryOS, func(b *BundleCtx) Step {
+		return saveSyslog(b.ps)
+	})
+	RegisterCollector("prometheus-metrics", CategoryKafka, func(b *BundleCtx) Step {
+		return func() error {
+			adm, err := b.adminClient()
+			if err != nil {
+				return fmt.Errorf("unable to initialize the admin client: %w", err)
+			}
+			return savePrometheusMetrics(b.ps, adm)()
+		}
+	})
+	RegisterCollector("dns", CategoryNetwork, func(b *BundleCtx) Step {
+		return saveDNSData(b.ps)
+	})
+	RegisterCollector("disk-usage", CategoryOS, func(b *BundleCtx) Step {
+		return saveDiskUsage(b.ps, b.conf)
+	})
+	RegisterCollector("logs", CategoryOS, func(b *BundleCtx) Step {
+		return saveLogs(b.ps, b.logsSince, b.logsUntil, b.logsLimitBytes)
+	})
+	RegisterCollector("socket-info", CategoryNetwork, func(b *BundleCtx) Step {
+		return saveSocketData(b.ps)
+	})
+	RegisterCollector("top", CategorySystem, func(b *BundleCtx) Step {
+		return saveTopOutput(b.ps)
+	})
+	RegisterCollector("vmstat", CategorySystem, func(b *BundleCtx) Step {
+		return saveVmstat(b.ps)
+	})
+	RegisterCollector("ip", CategoryNetwork, func(b *BundleCtx) Step {
+		return saveIp(b.ps)
+	})
+	RegisterCollector("lspci", CategorySystem, func(b *BundleCtx) Step {
+		return saveLspci(b.ps)
+	})
+	RegisterCollector("dmidecode", CategorySystem, func(b *BundleCtx) Step {
+		return saveDmidecode(b.ps)
+	})
+}
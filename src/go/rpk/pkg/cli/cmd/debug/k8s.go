@@ -0,0 +1,483 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+const (
+	k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sTokenFile         = k8sServiceAccountDir + "/token"
+	k8sCACertFile        = k8sServiceAccountDir + "/ca.crt"
+	k8sNamespaceFile     = k8sServiceAccountDir + "/namespace"
+)
+
+// runningInKubernetes reports whether this process is running inside a
+// Kubernetes Pod. It uses the same signals kubelet-adjacent tooling relies
+// on: the mounted service account directory, the 'KUBERNETES_SERVICE_HOST'
+// env var injected into every Pod, and the container's cgroup path.
+func runningInKubernetes(fs afero.Fs) bool {
+	if ok, err := afero.DirExists(fs, k8sServiceAccountDir); err == nil && ok {
+		return true
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return true
+	}
+	bs, err := afero.ReadFile(fs, "/proc/1/cgroup")
+	if err == nil && strings.Contains(string(bs), "kubepods") {
+		return true
+	}
+	return false
+}
+
+// k8sClient is a minimal client for the Kubernetes API server, authenticated
+// with the Pod's mounted service account. It intentionally avoids pulling in
+// a full API machinery/client-go dependency: the bundle only ever needs to
+// GET a handful of resources as raw JSON.
+type k8sClient struct {
+	http      *http.Client
+	baseURL   string
+	token     string
+	namespace string
+}
+
+// newK8sClient builds a k8sClient from the in-pod service account, using
+// 'namespace' if it's set and falling back to the pod's own namespace, as
+// read from the service account's namespace file, if it isn't.
+func newK8sClient(fs afero.Fs, namespace string) (*k8sClient, error) {
+	token, err := afero.ReadFile(fs, k8sTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the service account token: %w", err)
+	}
+	caCert, err := afero.ReadFile(fs, k8sCACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the service account CA cert: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("couldn't parse the service account CA cert")
+	}
+
+	if namespace == "" {
+		ns, err := afero.ReadFile(fs, k8sNamespaceFile)
+		if err == nil {
+			namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	if namespace == "" {
+		return nil, errors.New("unable to determine the pod's namespace; pass --namespace")
+	}
+
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	if host == "" {
+		return nil, errors.New("KUBERNETES_SERVICE_HOST is not set")
+	}
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if port == "" {
+		port = "443"
+	}
+
+	return &k8sClient{
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		baseURL:   fmt.Sprintf("https://%s:%s", host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: namespace,
+	}, nil
+}
+
+// get issues an authenticated GET against the API server and returns the raw
+// response body.
+func (c *k8sClient) get(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("kubernetes API returned %s: %s", resp.Status, body)
+	}
+	return body, nil
+}
+
+// getJSON is like get, but unmarshals the response into v.
+func (c *k8sClient) getJSON(path string, v interface{}) error {
+	bs, err := c.get(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+type k8sPod struct {
+	Metadata struct {
+		Namespace       string `json:"namespace"`
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name string `json:"name"`
+		} `json:"containers"`
+		Volumes []struct {
+			ConfigMap *struct {
+				Name string `json:"name"`
+			} `json:"configMap"`
+			Secret *struct {
+				SecretName string `json:"secretName"`
+			} `json:"secret"`
+		} `json:"volumes"`
+	} `json:"spec"`
+}
+
+func (c *k8sClient) podPath(name string) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", c.namespace, name)
+}
+
+func (c *k8sClient) fetchPod(name string) (*k8sPod, error) {
+	var pod k8sPod
+	if err := c.getJSON(c.podPath(name), &pod); err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+// saveK8sPodSpec saves the owning Pod's full object, equivalent to
+// 'kubectl get pod <name> -o yaml' but fetched directly through the API
+// server using the in-pod service account.
+func saveK8sPodSpec(ps *stepParams, kc *k8sClient, podName string) Step {
+	return func() error {
+		bs, err := kc.get(kc.podPath(podName))
+		if err != nil {
+			return fmt.Errorf("couldn't fetch pod '%s': %w", podName, err)
+		}
+		return writeFileToZip(ps, "k8s/pod.json", bs)
+	}
+}
+
+// saveK8sEvents saves every event involving the owning Pod, within its
+// namespace.
+func saveK8sEvents(ps *stepParams, kc *k8sClient, podName string) Step {
+	return func() error {
+		path := fmt.Sprintf(
+			"/api/v1/namespaces/%s/events?fieldSelector=%s",
+			kc.namespace,
+			url.QueryEscape(fmt.Sprintf("involvedObject.name=%s", podName)),
+		)
+		bs, err := kc.get(path)
+		if err != nil {
+			return fmt.Errorf("couldn't fetch events for pod '%s': %w", podName, err)
+		}
+		return writeFileToZip(ps, "k8s/events.json", bs)
+	}
+}
+
+// saveK8sLogs saves the current and previous logs of every container in the
+// owning Pod.
+func saveK8sLogs(ps *stepParams, kc *k8sClient, podName string) Step {
+	return func() error {
+		pod, err := kc.fetchPod(podName)
+		if err != nil {
+			return fmt.Errorf("couldn't fetch pod '%s' to list its containers: %w", podName, err)
+		}
+		var errs error
+		for _, ctr := range pod.Spec.Containers {
+			for _, previous := range []bool{false, true} {
+				path := fmt.Sprintf("%s/log?container=%s", kc.podPath(podName), ctr.Name)
+				filename := fmt.Sprintf("k8s/logs/%s.log", ctr.Name)
+				if previous {
+					path += "&previous=true"
+					filename = fmt.Sprintf("k8s/logs/%s-previous.log", ctr.Name)
+				}
+				bs, err := kc.get(path)
+				if err != nil {
+					// The previous container log is expected to be
+					// missing unless the container has restarted.
+					log.Debugf("couldn't fetch logs for container '%s' (previous=%v): %v", ctr.Name, previous, err)
+					continue
+				}
+				if err := writeFileToZip(ps, filename, bs); err != nil {
+					errs = combineErrs(errs, err)
+				}
+			}
+		}
+		return errs
+	}
+}
+
+// saveK8sOwner saves the Pod's owning StatefulSet or DaemonSet object.
+func saveK8sOwner(ps *stepParams, kc *k8sClient, podName string) Step {
+	return func() error {
+		pod, err := kc.fetchPod(podName)
+		if err != nil {
+			return fmt.Errorf("couldn't fetch pod '%s' to determine its owner: %w", podName, err)
+		}
+		for _, owner := range pod.Metadata.OwnerReferences {
+			var path string
+			switch owner.Kind {
+			case "StatefulSet":
+				path = fmt.Sprintf("/apis/apps/v1/namespaces/%s/statefulsets/%s", kc.namespace, owner.Name)
+			case "DaemonSet":
+				path = fmt.Sprintf("/apis/apps/v1/namespaces/%s/daemonsets/%s", kc.namespace, owner.Name)
+			default:
+				continue
+			}
+			bs, err := kc.get(path)
+			if err != nil {
+				return fmt.Errorf("couldn't fetch owner '%s/%s': %w", owner.Kind, owner.Name, err)
+			}
+			return writeFileToZip(ps, "k8s/owner.json", bs)
+		}
+		return errors.New("pod has no StatefulSet or DaemonSet owner")
+	}
+}
+
+// saveK8sConfig saves the ConfigMaps and Secrets referenced by the Pod's
+// volumes. Secret data is redacted; only the keys and metadata are kept so
+// that the bundle still shows what's referenced without leaking credentials.
+func saveK8sConfig(ps *stepParams, kc *k8sClient, podName string) Step {
+	return func() error {
+		pod, err := kc.fetchPod(podName)
+		if err != nil {
+			return fmt.Errorf("couldn't fetch pod '%s' to list its config references: %w", podName, err)
+		}
+
+		result := struct {
+			ConfigMaps []json.RawMessage `json:"configMaps"`
+			Secrets    []json.RawMessage `json:"secrets"`
+		}{}
+
+		for _, vol := range pod.Spec.Volumes {
+			if vol.ConfigMap != nil {
+				bs, err := kc.get(fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", kc.namespace, vol.ConfigMap.Name))
+				if err != nil {
+					log.Debugf("couldn't fetch configmap '%s': %v", vol.ConfigMap.Name, err)
+					continue
+				}
+				result.ConfigMaps = append(result.ConfigMaps, bs)
+			}
+			if vol.Secret != nil {
+				bs, err := kc.get(fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", kc.namespace, vol.Secret.SecretName))
+				if err != nil {
+					log.Debugf("couldn't fetch secret '%s': %v", vol.Secret.SecretName, err)
+					continue
+				}
+				redacted, err := redactSecretData(bs)
+				if err != nil {
+					log.Debugf("couldn't redact secret '%s': %v", vol.Secret.SecretName, err)
+					continue
+				}
+				result.Secrets = append(result.Secrets, redacted)
+			}
+		}
+
+		marshalled, err := json.Marshal(result)
+		if err != nil {
+			return fmt.Errorf("couldn't encode the referenced config: %w", err)
+		}
+		return writeFileToZip(ps, "k8s/config.json", marshalled)
+	}
+}
+
+// redactSecretData replaces a Secret's 'data' and 'stringData' values with a
+// placeholder, keeping only the keys so the bundle still shows what was set.
+func redactSecretData(raw json.RawMessage) (json.RawMessage, error) {
+	var secret map[string]interface{}
+	if err := json.Unmarshal(raw, &secret); err != nil {
+		return nil, err
+	}
+	redacted := "(REDACTED)"
+	for _, field := range []string{"data", "stringData"} {
+		m, ok := secret[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k := range m {
+			m[k] = redacted
+		}
+	}
+	return json.Marshal(secret)
+}
+
+// saveK8sNode saves a description of the node hosting the Pod. When the
+// 'kubectl' binary is available, its client-side 'describe' formatting is
+// used (honoring --kube-context); otherwise the raw Node object is fetched
+// directly from the API server.
+func saveK8sNode(ps *stepParams, kc *k8sClient, podName, kubeContext string) Step {
+	return func() error {
+		pod, err := kc.fetchPod(podName)
+		if err != nil {
+			return fmt.Errorf("couldn't fetch pod '%s' to determine its node: %w", podName, err)
+		}
+		if pod.Spec.NodeName == "" {
+			return errors.New("pod has not been scheduled to a node yet")
+		}
+
+		if path, err := exec.LookPath("kubectl"); err == nil {
+			args := []string{path, "describe", "node", pod.Spec.NodeName}
+			if kubeContext != "" {
+				args = append(args, "--context", kubeContext)
+			}
+			return writeCommandOutputToZip(ps, "k8s/node.txt", args[0], args[1:]...)
+		}
+
+		bs, err := kc.get(fmt.Sprintf("/api/v1/nodes/%s", pod.Spec.NodeName))
+		if err != nil {
+			return fmt.Errorf("couldn't fetch node '%s': %w", pod.Spec.NodeName, err)
+		}
+		return writeFileToZip(ps, "k8s/node.json", bs)
+	}
+}
+
+// k8sBundleInfo is the Kubernetes context shared by every k8s-* collector
+// for a single 'rpk debug bundle' run: an authenticated client and the name
+// of the Pod we're running in.
+type k8sBundleInfo struct {
+	client      *k8sClient
+	podName     string
+	kubeContext string
+}
+
+// detectKubernetesBundleInfo returns the Kubernetes context to pass to the
+// k8s-* collectors, or nil, falling back to the regular journald-based
+// collection, if the Pod's name can't be determined or the API server isn't
+// reachable.
+func detectKubernetesBundleInfo(ps *stepParams, namespace, kubeContext string) *k8sBundleInfo {
+	podName := os.Getenv("HOSTNAME")
+	if podName == "" {
+		log.Debug("HOSTNAME is not set; can't determine the current pod's name")
+		return nil
+	}
+
+	kc, err := newK8sClient(ps.fs, namespace)
+	if err != nil {
+		log.Debugf("falling back to journald-based log collection: %v", err)
+		return nil
+	}
+
+	// Fail fast: if the API server isn't reachable, don't bother
+	// running the k8s-specific collectors at all.
+	if _, err := kc.get(kc.podPath(podName)); err != nil {
+		log.Debugf("kubernetes API unreachable, falling back to journald-based log collection: %v", err)
+		return nil
+	}
+
+	return &k8sBundleInfo{client: kc, podName: podName, kubeContext: kubeContext}
+}
+
+func init() {
+	// b.k8s() does a real API server round trip the first time it's
+	// called, so each of these defers it into the returned Step, which
+	// runs in its own goroutine, rather than calling it here in the build
+	// function, which executeBundle invokes synchronously while
+	// dispatching every collector.
+	RegisterCollector("k8s-pod", CategoryKubernetes, func(b *BundleCtx) Step {
+		return func() error {
+			info := b.k8s()
+			if info == nil {
+				return nil
+			}
+			return saveK8sPodSpec(b.ps, info.client, info.podName)()
+		}
+	})
+	RegisterCollector("k8s-events", CategoryKubernetes, func(b *BundleCtx) Step {
+		return func() error {
+			info := b.k8s()
+			if info == nil {
+				return nil
+			}
+			return saveK8sEvents(b.ps, info.client, info.podName)()
+		}
+	})
+	RegisterCollector("k8s-logs", CategoryKubernetes, func(b *BundleCtx) Step {
+		return func() error {
+			info := b.k8s()
+			if info == nil {
+				return nil
+			}
+			return saveK8sLogs(b.ps, info.client, info.podName)()
+		}
+	})
+	RegisterCollector("k8s-owner", CategoryKubernetes, func(b *BundleCtx) Step {
+		return func() error {
+			info := b.k8s()
+			if info == nil {
+				return nil
+			}
+			return saveK8sOwner(b.ps, info.client, info.podName)()
+		}
+	})
+	RegisterCollector("k8s-config", CategoryKubernetes, func(b *BundleCtx) Step {
+		return func() error {
+			info := b.k8s()
+			if info == nil {
+				return nil
+			}
+			return saveK8sConfig(b.ps, info.client, info.podName)()
+		}
+	})
+	RegisterCollector("k8s-node", CategoryKubernetes, func(b *BundleCtx) Step {
+		return func() error {
+			info := b.k8s()
+			if info == nil {
+				return nil
+			}
+			return saveK8sNode(b.ps, info.client, info.podName, info.kubeContext)()
+		}
+	})
+}
+
+// combineErrs appends 'next' to 'errs', returning whichever of the two is
+// non-nil when the other is empty.
+func combineErrs(errs, next error) error {
+	if errs == nil {
+		return next
+	}
+	if next == nil {
+		return errs
+	}
+	return fmt.Errorf("%w; %v", errs, next)
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactSecretData(t *testing.T) {
+	raw := json.RawMessage(`{
+		"metadata": {"name": "redpanda-certs"},
+		"data": {"tls.key": "c2VjcmV0"},
+		"stringData": {"password": "hunter2"}
+	}`)
+
+	redacted, err := redactSecretData(raw)
+	require.NoError(t, err)
+
+	var secret map[string]interface{}
+	require.NoError(t, json.Unmarshal(redacted, &secret))
+
+	data := secret["data"].(map[string]interface{})
+	require.Equal(t, "(REDACTED)", data["tls.key"])
+
+	stringData := secret["stringData"].(map[string]interface{})
+	require.Equal(t, "(REDACTED)", stringData["password"])
+
+	metadata := secret["metadata"].(map[string]interface{})
+	require.Equal(t, "redpanda-certs", metadata["name"])
+}
+
+func TestCombineErrs(t *testing.T) {
+	errA := errors.New("a failed")
+	errB := errors.New("b failed")
+
+	require.NoError(t, combineErrs(nil, nil))
+	require.Equal(t, errA, combineErrs(nil, errA))
+	require.Equal(t, errA, combineErrs(errA, nil))
+	require.EqualError(t, combineErrs(errA, errB), "a failed; b failed")
+}
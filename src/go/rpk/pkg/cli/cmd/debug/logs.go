@@ -0,0 +1,454 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+const (
+	dockerSock     = "/var/run/docker.sock"
+	containerdSock = "/run/containerd/containerd.sock"
+)
+
+// aggregateLogsLimitFactor bounds the total size of every log file
+// collected through the container-runtime fallback chain, relative to the
+// per-file --logs-size-limit, so that a pod with many matching containers
+// or log files can't produce an unbounded bundle. This is documented to
+// users in --logs-size-limit's help text.
+const aggregateLogsLimitFactor = 5
+
+// Writes the journald redpanda logs, if available, to the bundle. When
+// there's no 'redpanda' journald unit - the common case inside a container -
+// this falls back, in order, to: pod/container log files under
+// /var/log/pods and /var/log/containers, the container runtime socket
+// (docker or containerd), and finally $RPK_LOG_PATH. When running inside a
+// Kubernetes Pod, this is complemented by the k8s-logs collector, which
+// pulls logs through the Kubernetes API instead.
+func saveLogs(ps *stepParams, since, until string, logsLimitBytes int) Step {
+	return func() error {
+		// Normalize to the "<=0 means unlimited" convention used
+		// throughout this fallback chain, as a single negative sentinel,
+		// so that downstream helpers (and writeCommandOutputToZipLimit's
+		// own 0-means-"write nothing" case) never see a literal 0 unless
+		// it's genuinely an exhausted budget.
+		limit := normalizeLogsLimit(logsLimitBytes)
+
+		if journaldHasUnit(ps.timeout) {
+			return saveJournaldLogs(ps, since, until, limit)
+		}
+		log.Debug("no 'redpanda' journald unit found; falling back to container-based log collection")
+
+		sinceT, untilT, err := parseLogWindow(since, until)
+		if err != nil {
+			return err
+		}
+
+		budget := newLogBudget(limit)
+		var errs error
+		found := 0
+
+		n, err := savePodLogFiles(ps, sinceT, untilT, limit, budget)
+		found += n
+		errs = combineErrs(errs, err)
+
+		n, err = saveContainerRuntimeLogs(ps, limit, budget)
+		found += n
+		errs = combineErrs(errs, err)
+
+		if path := os.Getenv("RPK_LOG_PATH"); path != "" {
+			if err := saveEnvLogFile(ps, path, limit, budget); err != nil {
+				errs = combineErrs(errs, err)
+			} else {
+				found++
+			}
+		}
+
+		if found == 0 {
+			errs = combineErrs(errs, errors.New(
+				"no redpanda logs found via journald, pod/container log files, "+
+					"the container runtime, or $RPK_LOG_PATH",
+			))
+		}
+		return errs
+	}
+}
+
+// normalizeLogsLimit turns the "<=0 means unlimited" convention used by
+// --logs-size-limit into the single negative sentinel writeCommandOutputToZipLimit
+// and limitedWriter expect, so that a literal 0 passed around this file always
+// means "write nothing" (an exhausted budget), never "no limit".
+func normalizeLogsLimit(logsLimitBytes int) int {
+	if logsLimitBytes <= 0 {
+		return -1
+	}
+	return logsLimitBytes
+}
+
+// journaldHasUnit reports whether journald knows about a 'redpanda' unit,
+// by checking whether it has any log entries at all for one.
+func journaldHasUnit(timeout time.Duration) bool {
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "journalctl", "--no-pager", "--quiet", "-u", "redpanda", "-n", "1").Output()
+	if err != nil {
+		return false
+	}
+	return len(bytes.TrimSpace(out)) > 0
+}
+
+func saveJournaldLogs(ps *stepParams, since, until string, logsLimitBytes int) error {
+	args := []string{"--no-pager", "-u", "redpanda"}
+	if since != "" {
+		args = append(args, "--since", since)
+	}
+	if until != "" {
+		args = append(args, "--until", until)
+	}
+	return writeCommandOutputToZipLimit(
+		ps,
+		"logs/journald/redpanda.log",
+		logsLimitBytes,
+		"journalctl",
+		args...,
+	)
+}
+
+// logBudget caps the aggregate size of every log file written through the
+// fallback chain, on top of the existing per-file cap.
+type logBudget struct {
+	mu        sync.Mutex
+	remaining int // negative means unlimited
+}
+
+func newLogBudget(logsLimitBytes int) *logBudget {
+	if logsLimitBytes <= 0 {
+		return &logBudget{remaining: -1}
+	}
+	return &logBudget{remaining: logsLimitBytes * aggregateLogsLimitFactor}
+}
+
+// take reserves up to 'want' bytes from the aggregate budget, returning how
+// many of them the caller is actually allowed to write.
+func (b *logBudget) take(want int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining < 0 {
+		return want
+	}
+	if want > b.remaining {
+		want = b.remaining
+	}
+	b.remaining -= want
+	return want
+}
+
+// logWindowLayouts are the subset of journalctl's date formats this fallback
+// path understands well enough to filter CRI log timestamps by. Since/until
+// values in any other format are passed through to journald as before, but
+// make the fallback chain fail with a parse error without collecting any
+// fallback logs.
+var logWindowLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func parseLogWindow(since, until string) (time.Time, time.Time, error) {
+	parse := func(s string) (time.Time, error) {
+		if s == "" {
+			return time.Time{}, nil
+		}
+		for _, layout := range logWindowLayouts {
+			if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf(
+			"couldn't parse '%s' as a date for container log filtering; supported formats are YYYY-MM-DD and YYYY-MM-DD HH:MM:SS",
+			s,
+		)
+	}
+	sinceT, err := parse(since)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	untilT, err := parse(until)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return sinceT, untilT, nil
+}
+
+// savePodLogFiles looks for redpanda log files under the well-known paths
+// the kubelet writes pod/container logs to, filtering by the since/until
+// window using the CRI log line timestamp prefix.
+func savePodLogFiles(ps *stepParams, since, until time.Time, logsLimitBytes int, budget *logBudget) (int, error) {
+	var errs error
+	count := 0
+
+	podDirs, _ := afero.Glob(ps.fs, "/var/log/pods/*/redpanda*")
+	for _, dir := range podDirs {
+		err := afero.Walk(ps.fs, dir, func(path string, info os.FileInfo, walkErr error) error {
+			if walkErr != nil || info == nil || info.IsDir() || !strings.HasSuffix(path, ".log") {
+				return nil
+			}
+			if err := saveCRILogFile(ps, "pods", path, since, until, logsLimitBytes, budget); err != nil {
+				errs = combineErrs(errs, err)
+				return nil
+			}
+			count++
+			return nil
+		})
+		errs = combineErrs(errs, err)
+	}
+
+	containerLogs, _ := afero.Glob(ps.fs, "/var/log/containers/*redpanda*.log")
+	for _, path := range containerLogs {
+		if err := saveCRILogFile(ps, "containers", path, since, until, logsLimitBytes, budget); err != nil {
+			errs = combineErrs(errs, err)
+			continue
+		}
+		count++
+	}
+
+	return count, errs
+}
+
+// saveCRILogFile reads a single CRI-formatted log file, filters it by the
+// since/until window, and saves it to the bundle under
+// logs/<source>/<file>.
+func saveCRILogFile(ps *stepParams, source, path string, since, until time.Time, logsLimitBytes int, budget *logBudget) error {
+	bs, err := afero.ReadFile(ps.fs, path)
+	if err != nil {
+		return fmt.Errorf("couldn't read '%s': %w", path, err)
+	}
+
+	filtered := filterCRILogLines(bs, since, until)
+	filtered = applyLimits(filtered, logsLimitBytes, budget)
+
+	filename := fmt.Sprintf("logs/%s/%s", source, filepath.Base(path))
+	return writeFileToZip(ps, filename, filtered)
+}
+
+// filterCRILogLines drops every line outside of [since, until], using the
+// timestamp CRI-compliant runtimes (containerd, CRI-O) prefix each log line
+// with, e.g. "2006-01-02T15:04:05.000000000Z stdout F <msg>".
+func filterCRILogLines(bs []byte, since, until time.Time) []byte {
+	if since.IsZero() && until.IsZero() {
+		return bs
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if ts, ok := parseCRILogTimestamp(line); ok {
+			if !since.IsZero() && ts.Before(since) {
+				continue
+			}
+			if !until.IsZero() && ts.After(until) {
+				continue
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+func parseCRILogTimestamp(line string) (time.Time, bool) {
+	prefix := strings.SplitN(line, " ", 2)[0]
+	ts, err := time.Parse(time.RFC3339Nano, prefix)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// saveContainerRuntimeLogs pulls logs for every redpanda-looking container
+// directly from a reachable container runtime socket.
+func saveContainerRuntimeLogs(ps *stepParams, logsLimitBytes int, budget *logBudget) (int, error) {
+	if ok, _ := afero.Exists(ps.fs, dockerSock); ok {
+		return saveDockerLogs(ps, logsLimitBytes, budget)
+	}
+	if ok, _ := afero.Exists(ps.fs, containerdSock); ok {
+		return saveContainerdLogs(ps, logsLimitBytes, budget)
+	}
+	return 0, nil
+}
+
+type dockerContainer struct {
+	ID    string   `json:"Id"`
+	Names []string `json:"Names"`
+	Image string   `json:"Image"`
+}
+
+func saveDockerLogs(ps *stepParams, logsLimitBytes int, budget *logBudget) (int, error) {
+	client := &http.Client{
+		Timeout: ps.timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", dockerSock)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://unix/containers/json?all=true")
+	if err != nil {
+		return 0, fmt.Errorf("couldn't list containers via the docker socket: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return 0, fmt.Errorf("couldn't parse the docker container list: %w", err)
+	}
+
+	var errs error
+	count := 0
+	for _, c := range containers {
+		name := strings.TrimPrefix(firstOr(c.Names, c.ID), "/")
+		if !strings.Contains(name, "redpanda") && !strings.Contains(c.Image, "redpanda") {
+			continue
+		}
+
+		logResp, err := client.Get(fmt.Sprintf(
+			"http://unix/containers/%s/logs?stdout=true&stderr=true&timestamps=true", c.ID,
+		))
+		if err != nil {
+			errs = combineErrs(errs, fmt.Errorf("couldn't fetch logs for container '%s': %w", name, err))
+			continue
+		}
+		bs, err := io.ReadAll(logResp.Body)
+		logResp.Body.Close()
+		if err != nil {
+			errs = combineErrs(errs, fmt.Errorf("couldn't read logs for container '%s': %w", name, err))
+			continue
+		}
+
+		if err := writeFileToZip(ps, fmt.Sprintf("logs/docker/%s.log", name), applyLimits(bs, logsLimitBytes, budget)); err != nil {
+			errs = combineErrs(errs, err)
+			continue
+		}
+		count++
+	}
+	return count, errs
+}
+
+func firstOr(xs []string, fallback string) string {
+	if len(xs) > 0 {
+		return xs[0]
+	}
+	return fallback
+}
+
+// saveContainerdLogs shells out to 'crictl', the standard CRI debugging
+// CLI, since containerd's own API is a gRPC service with no stable,
+// dependency-free Go client worth vendoring just for this. If 'crictl'
+// isn't installed, this is a no-op.
+func saveContainerdLogs(ps *stepParams, logsLimitBytes int, budget *logBudget) (int, error) {
+	crictl, err := exec.LookPath("crictl")
+	if err != nil {
+		log.Debug("containerd socket found but 'crictl' isn't available; skipping containerd-based log collection")
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, crictl, "ps", "-a", "-o", "json").Output()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't list containers via crictl: %w", err)
+	}
+
+	var parsed struct {
+		Containers []struct {
+			ID       string `json:"id"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Image struct {
+				Image string `json:"image"`
+			} `json:"image"`
+		} `json:"containers"`
+	}
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return 0, fmt.Errorf("couldn't parse crictl output: %w", err)
+	}
+
+	var errs error
+	count := 0
+	for _, c := range parsed.Containers {
+		if !strings.Contains(c.Metadata.Name, "redpanda") && !strings.Contains(c.Image.Image, "redpanda") {
+			continue
+		}
+		// logsLimitBytes is already normalized to -1 (unlimited) by
+		// saveLogs, so this honors the same convention as the pod-file
+		// and docker-socket paths: unlimited per-file stays unlimited
+		// here too, and only a truly exhausted aggregate budget caps it
+		// to 0, which writeCommandOutputToZipLimit treats as "skip".
+		limit := budget.take(logsLimitBytes)
+		if limit == 0 {
+			log.Debugf("skipping containerd logs for '%s': aggregate log budget exhausted", c.Metadata.Name)
+			continue
+		}
+		filename := fmt.Sprintf("logs/containerd/%s.log", c.Metadata.Name)
+		if err := writeCommandOutputToZipLimit(ps, filename, limit, crictl, "logs", c.ID); err != nil {
+			errs = combineErrs(errs, err)
+			continue
+		}
+		count++
+	}
+	return count, errs
+}
+
+func saveEnvLogFile(ps *stepParams, path string, logsLimitBytes int, budget *logBudget) error {
+	bs, err := afero.ReadFile(ps.fs, path)
+	if err != nil {
+		return fmt.Errorf("couldn't read $RPK_LOG_PATH ('%s'): %w", path, err)
+	}
+	return writeFileToZip(ps, fmt.Sprintf("logs/env/%s", filepath.Base(path)), applyLimits(bs, logsLimitBytes, budget))
+}
+
+// applyLimits truncates bs to at most logsLimitBytes, then further truncates
+// it to whatever remains of the aggregate budget.
+func applyLimits(bs []byte, logsLimitBytes int, budget *logBudget) []byte {
+	if logsLimitBytes > 0 && len(bs) > logsLimitBytes {
+		bs = bs[:logsLimitBytes]
+	}
+	if n := budget.take(len(bs)); n < len(bs) {
+		bs = bs[:n]
+	}
+	return bs
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCRILogTimestamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected time.Time
+		ok       bool
+	}{{
+		name:     "a well-formed CRI log line",
+		line:     "2021-10-04T15:04:05.123456789Z stdout F starting up",
+		expected: time.Date(2021, 10, 4, 15, 4, 5, 123456789, time.UTC),
+		ok:       true,
+	}, {
+		name: "a line with no timestamp prefix",
+		line: "starting up",
+	}, {
+		name: "an empty line",
+		line: "",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(st *testing.T) {
+			ts, ok := parseCRILogTimestamp(tt.line)
+			require.Equal(st, tt.ok, ok)
+			if tt.ok {
+				require.True(st, tt.expected.Equal(ts))
+			}
+		})
+	}
+}
+
+func TestFilterCRILogLines(t *testing.T) {
+	lines := []string{
+		"2021-10-04T10:00:00.000000000Z stdout F too early",
+		"2021-10-04T12:00:00.000000000Z stdout F in window",
+		"2021-10-04T14:00:00.000000000Z stdout F too late",
+		"not a CRI timestamp, kept regardless of the window",
+	}
+	var bs []byte
+	for _, l := range lines {
+		bs = append(bs, []byte(l+"\n")...)
+	}
+
+	tests := []struct {
+		name          string
+		since, until  time.Time
+		expectedLines []string
+	}{{
+		name:          "no window keeps everything untouched",
+		expectedLines: lines,
+	}, {
+		name:  "since/until drops lines outside the window, keeping unparseable ones",
+		since: time.Date(2021, 10, 4, 11, 0, 0, 0, time.UTC),
+		until: time.Date(2021, 10, 4, 13, 0, 0, 0, time.UTC),
+		expectedLines: []string{
+			"2021-10-04T12:00:00.000000000Z stdout F in window",
+			"not a CRI timestamp, kept regardless of the window",
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(st *testing.T) {
+			filtered := filterCRILogLines(bs, tt.since, tt.until)
+			var expected []byte
+			for _, l := range tt.expectedLines {
+				expected = append(expected, []byte(l+"\n")...)
+			}
+			require.Equal(st, string(expected), string(filtered))
+		})
+	}
+}
+
+func TestLogBudgetTake(t *testing.T) {
+	t.Run("an unlimited budget always returns what's asked for", func(st *testing.T) {
+		b := newLogBudget(-1)
+		require.Equal(st, 100, b.take(100))
+		require.Equal(st, 5000, b.take(5000))
+	})
+
+	t.Run("a bounded budget caps and depletes across calls", func(st *testing.T) {
+		b := newLogBudget(10) // aggregate = 10 * aggregateLogsLimitFactor = 50
+		require.Equal(st, 30, b.take(30))
+		require.Equal(st, 20, b.take(30)) // only 20 left of the 50 budget
+		require.Equal(st, 0, b.take(30))  // fully exhausted
+	})
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/vectorizedio/redpanda/src/go/rpk/pkg/api/admin"
+	"github.com/vectorizedio/redpanda/src/go/rpk/pkg/config"
+)
+
+// Category groups related collectors together, so that they can be
+// selected as a whole, e.g. '--only kafka' or '--exclude network'.
+type Category string
+
+const (
+	CategoryKafka      Category = "kafka"
+	CategorySystem     Category = "system"
+	CategoryOS         Category = "os"
+	CategoryNetwork    Category = "network"
+	CategoryKubernetes Category = "kubernetes"
+)
+
+// Step is a single unit of bundle collection work, run concurrently with
+// every other selected collector's Step.
+type Step func() error
+
+// BundleCtx holds everything a collector might need to build its Step. It's
+// assembled once per 'rpk debug bundle' invocation and handed to every
+// registered collector's build function.
+//
+// The Kafka/admin clients and the Kubernetes context are all expensive or
+// fallible to set up (they talk to a broker, an admin API, or a cluster API
+// server), so they're handed over as lazily-memoized functions rather than
+// already-built values: a collector that never calls KafkaClient/AdminClient/
+// K8s never pays for it, and a run scoped with --only/--include/--exclude to
+// collectors that don't need one of them doesn't fail just because it's
+// unreachable. Its fields are unexported - out-of-tree collectors read and
+// write through the methods below rather than reaching into it directly.
+type BundleCtx struct {
+	ps   *stepParams
+	conf *config.Config
+
+	kafkaClient func() (*kgo.Client, error)
+	adminClient func() (*admin.AdminAPI, error)
+
+	logsSince      string
+	logsUntil      string
+	logsLimitBytes int
+
+	// k8s returns the Kubernetes context this is running in, or nil
+	// outside of a Pod or when the API server isn't reachable; collectors
+	// that only apply there should return a nil-returning Step when it
+	// returns nil. Calling it may do a real API server round trip, so
+	// collectors must only call it from inside their returned Step, never
+	// from their build function, or they'd block every other collector's
+	// dispatch.
+	k8s func() *k8sBundleInfo
+}
+
+// Conf returns the redpanda config this bundle run was loaded with.
+func (b *BundleCtx) Conf() *config.Config { return b.conf }
+
+// KafkaClient returns a Kafka client for the cluster being debugged,
+// constructing it on first use.
+func (b *BundleCtx) KafkaClient() (*kgo.Client, error) { return b.kafkaClient() }
+
+// AdminClient returns an admin API client for the cluster being debugged,
+// constructing it on first use.
+func (b *BundleCtx) AdminClient() (*admin.AdminAPI, error) { return b.adminClient() }
+
+// LogsSince returns the --logs-since value for this run, or "" if unset.
+func (b *BundleCtx) LogsSince() string { return b.logsSince }
+
+// LogsUntil returns the --logs-until value for this run, or "" if unset.
+func (b *BundleCtx) LogsUntil() string { return b.logsUntil }
+
+// LogsLimitBytes returns the per-file --logs-size-limit for this run, in
+// bytes; <= 0 means unlimited.
+func (b *BundleCtx) LogsLimitBytes() int { return b.logsLimitBytes }
+
+// K8s returns the Kubernetes context this is running in, or nil outside of
+// a Pod or when the API server isn't reachable. This may do a real API
+// server round trip on first call - only call it from inside a Step, not
+// from a CollectorBuild, so it doesn't block other collectors' dispatch.
+func (b *BundleCtx) K8s() *k8sBundleInfo { return b.k8s() }
+
+// WriteFile creates a file in the bundle at path and writes contents to it.
+func (b *BundleCtx) WriteFile(path string, contents []byte) error {
+	return writeFileToZip(b.ps, path, contents)
+}
+
+// WriteCommandOutput runs command and pipes its output to a new file in the
+// bundle at path.
+func (b *BundleCtx) WriteCommandOutput(path, command string, args ...string) error {
+	return writeCommandOutputToZip(b.ps, path, command, args...)
+}
+
+// WriteCommandOutputLimit is like WriteCommandOutput, but stops the command
+// once limitBytes of output have been written; limitBytes <= 0 means
+// unlimited.
+func (b *BundleCtx) WriteCommandOutputLimit(path string, limitBytes int, command string, args ...string) error {
+	return writeCommandOutputToZipLimit(b.ps, path, normalizeLogsLimit(limitBytes), command, args...)
+}
+
+// CollectorBuild builds the Step for a registered collector given the
+// current bundle context. It may return a nil Step if the collector isn't
+// applicable to this run. The Kubernetes collectors can't tell that at build
+// time (see BundleCtx.K8s), so they always return a Step, which does nothing
+// outside of a Pod.
+type CollectorBuild func(b *BundleCtx) Step
+
+// registeredCollector is a named, categorized data source that
+// 'rpk debug bundle' can collect. Out-of-tree packages can add their own by
+// calling RegisterCollector from an init function.
+type registeredCollector struct {
+	name     string
+	category Category
+	build    CollectorBuild
+}
+
+// collectors is the registry of every collector known to 'rpk debug
+// bundle', populated by RegisterCollector calls in this package's init
+// functions, and by any out-of-tree package that imports this one.
+var collectors []registeredCollector
+
+// RegisterCollector adds a collector to the registry. name should be
+// unique, lowercase, and hyphenated (e.g. "kafka-metadata"); it's what users
+// pass to --include/--exclude/--only and what 'list-collectors' prints.
+//
+// Out-of-tree packages can add their own collectors without editing
+// executeBundle by calling this from an init function, e.g.:
+//
+//	func init() {
+//		debug.RegisterCollector("my-thing", debug.CategoryOS, func(b *debug.BundleCtx) debug.Step {
+//			return func() error {
+//				return b.WriteFile("my-thing.txt", []byte("hello"))
+//			}
+//		})
+//	}
+func RegisterCollector(name string, cat Category, build CollectorBuild) {
+	collectors = append(collectors, registeredCollector{
+		name:     name,
+		category: cat,
+		build:    build,
+	})
+}
+
+// matchesAny reports whether name matches any of the given glob patterns,
+// or equals any of them outright. It also matches a collector's category
+// against the same patterns, so that e.g. "network" selects every collector
+// in the network category.
+func matchesAny(c registeredCollector, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, c.name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, string(c.category)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectCollectors filters the registry down to the collectors that should
+// run, given the --only, --include and --exclude patterns.
+//
+// The base set is every registered collector, or, if --only is non-empty,
+// just the ones matching it. --exclude then removes matches from that set,
+// and --include adds matches back in regardless of --only/--exclude. This
+// lets callers do e.g. '--only kafka-* --include logs' or
+// '--exclude network --include dns'.
+func selectCollectors(all []registeredCollector, only, include, exclude []string) []registeredCollector {
+	var base []registeredCollector
+	if len(only) == 0 {
+		base = all
+	} else {
+		for _, c := range all {
+			if matchesAny(c, only) {
+				base = append(base, c)
+			}
+		}
+	}
+
+	selected := make(map[string]registeredCollector)
+	for _, c := range base {
+		if len(exclude) > 0 && matchesAny(c, exclude) {
+			continue
+		}
+		selected[c.name] = c
+	}
+	for _, c := range all {
+		if matchesAny(c, include) {
+			selected[c.name] = c
+		}
+	}
+
+	var result []registeredCollector
+	for _, c := range all {
+		if _, ok := selected[c.name]; ok {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// formatCollectorList renders the registry as "name  category" lines, the
+// name left-aligned and padded to a fixed column width, for 'rpk debug
+// bundle list-collectors'.
+func formatCollectorList(all []registeredCollector) string {
+	out := ""
+	for _, c := range all {
+		out += fmt.Sprintf("%-20s %s\n", c.name, c.category)
+	}
+	return out
+}
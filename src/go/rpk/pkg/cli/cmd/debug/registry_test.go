@@ -0,0 +1,114 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectCollectors(t *testing.T) {
+	all := []registeredCollector{
+		{name: "kafka-metadata", category: CategoryKafka},
+		{name: "config", category: CategoryOS},
+		{name: "logs", category: CategoryOS},
+		{name: "dns", category: CategoryNetwork},
+		{name: "k8s-pod", category: CategoryKubernetes},
+	}
+	names := func(cs []registeredCollector) []string {
+		var out []string
+		for _, c := range cs {
+			out = append(out, c.name)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name                   string
+		only, include, exclude []string
+		expected               []string
+	}{{
+		name:     "no filters runs everything",
+		expected: []string{"kafka-metadata", "config", "logs", "dns", "k8s-pod"},
+	}, {
+		name:     "only a category selects just that category",
+		only:     []string{"os"},
+		expected: []string{"config", "logs"},
+	}, {
+		name:     "only a glob selects matching names",
+		only:     []string{"kafka-*"},
+		expected: []string{"kafka-metadata"},
+	}, {
+		name:     "exclude removes matches from the base set",
+		exclude:  []string{"kafka-metadata", "k8s-pod"},
+		expected: []string{"config", "logs", "dns"},
+	}, {
+		name:     "include adds matches back regardless of only/exclude",
+		only:     []string{"kafka-*"},
+		include:  []string{"logs"},
+		expected: []string{"kafka-metadata", "logs"},
+	}, {
+		name:     "only and exclude can both apply",
+		only:     []string{"os", "network"},
+		exclude:  []string{"dns"},
+		expected: []string{"config", "logs"},
+	}, {
+		name:     "an only pattern matching nothing selects nothing",
+		only:     []string{"doesnt-exist"},
+		expected: nil,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(st *testing.T) {
+			result := selectCollectors(all, tt.only, tt.include, tt.exclude)
+			require.Equal(st, tt.expected, names(result))
+		})
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	c := registeredCollector{name: "kafka-metadata", category: CategoryKafka}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		expected bool
+	}{{
+		name:     "matches by exact name",
+		patterns: []string{"kafka-metadata"},
+		expected: true,
+	}, {
+		name:     "matches by category",
+		patterns: []string{"kafka"},
+		expected: true,
+	}, {
+		name:     "matches by glob",
+		patterns: []string{"kafka-*"},
+		expected: true,
+	}, {
+		name:     "no match",
+		patterns: []string{"logs", "os"},
+		expected: false,
+	}, {
+		name:     "empty patterns never match",
+		patterns: nil,
+		expected: false,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(st *testing.T) {
+			require.Equal(st, tt.expected, matchesAny(c, tt.patterns))
+		})
+	}
+}
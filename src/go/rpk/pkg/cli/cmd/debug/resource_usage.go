@@ -0,0 +1,411 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/vectorizedio/redpanda/src/go/rpk/pkg/config"
+)
+
+// clockTicksPerSec is the kernel's USER_HZ, used to convert the jiffy-based
+// utime/stime counters in /proc/[pid]/stat into seconds. It's 100 on every
+// platform redpanda supports.
+const clockTicksPerSec = 100
+
+// resourceSample is a single point in the resource-usage.jsonl time series.
+type resourceSample struct {
+	Timestamp  time.Time `json:"timestamp"`
+	CPUPercent float64   `json:"cpuPercent"`
+	RSSBytes   uint64    `json:"rssBytes"`
+	AnonBytes  uint64    `json:"anonBytes"`
+	FileBytes  uint64    `json:"fileBytes"`
+	PSSBytes   uint64    `json:"pssBytes"`
+	ReadBytes  uint64    `json:"readBytes"`  // since the previous sample
+	WriteBytes uint64    `json:"writeBytes"` // since the previous sample
+	OpenFDs    int       `json:"openFds"`
+	Threads    int       `json:"threads"`
+	CPUs       []cpuStat `json:"cpus"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// cpuStat is the steal/iowait percentage for a single CPU, computed from the
+// delta between two /proc/stat reads.
+type cpuStat struct {
+	CPU           string  `json:"cpu"`
+	StealPercent  float64 `json:"stealPercent"`
+	IowaitPercent float64 `json:"iowaitPercent"`
+}
+
+// procCPUTime is the subset of /proc/[pid]/stat this sampler cares about.
+type procCPUTime struct {
+	utime, stime uint64
+}
+
+// cpuTimes is the subset of a /proc/stat "cpu*" line this sampler cares
+// about, in USER_HZ jiffies.
+type cpuTimes struct {
+	total, iowait, steal uint64
+}
+
+// procIOBytes is the cumulative read/write counters from /proc/[pid]/io.
+type procIOBytes struct {
+	read, write uint64
+}
+
+// findRedpandaPID scans /proc for a process whose comm is "redpanda".
+func findRedpandaPID(fs afero.Fs) (int, error) {
+	entries, err := afero.ReadDir(fs, "/proc")
+	if err != nil {
+		return 0, fmt.Errorf("couldn't list /proc: %w", err)
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := afero.ReadFile(fs, fmt.Sprintf("/proc/%d/comm", pid))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == "redpanda" {
+			return pid, nil
+		}
+	}
+	return 0, errors.New("couldn't find a running 'redpanda' process")
+}
+
+func readProcCPUTime(fs afero.Fs, pid int) (procCPUTime, error) {
+	bs, err := afero.ReadFile(fs, fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procCPUTime{}, err
+	}
+	// The process name field (2nd field) is parenthesized and may itself
+	// contain spaces, so split on the closing paren rather than on every
+	// space.
+	i := strings.LastIndex(string(bs), ")")
+	if i < 0 {
+		return procCPUTime{}, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	fields := strings.Fields(string(bs[i+2:]))
+	// Fields here start at field 3 (state); utime is field 14, stime is
+	// field 15, i.e. indices 11 and 12 of this slice.
+	if len(fields) < 13 {
+		return procCPUTime{}, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return procCPUTime{}, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return procCPUTime{}, err
+	}
+	return procCPUTime{utime: utime, stime: stime}, nil
+}
+
+func readProcStatusField(fs afero.Fs, pid int, field string) (uint64, error) {
+	f, err := fs.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, field+":") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("unexpected status line %q", line)
+		}
+		// Values are reported in kB.
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	return 0, fmt.Errorf("field %q not found in /proc/%d/status", field, pid)
+}
+
+func readProcThreads(fs afero.Fs, pid int) (int, error) {
+	// readProcStatusField scales every value from kB to bytes, but
+	// "Threads" is a plain count, so undo that scaling here.
+	v, err := readProcStatusField(fs, pid, "Threads")
+	return int(v / 1024), err
+}
+
+func readSmapsRollupPSS(fs afero.Fs, pid int) (uint64, error) {
+	f, err := fs.Open(fmt.Sprintf("/proc/%d/smaps_rollup", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Pss:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("unexpected smaps_rollup line %q", line)
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	return 0, errors.New("Pss field not found in smaps_rollup")
+}
+
+func readProcIOBytes(fs afero.Fs, pid int) (procIOBytes, error) {
+	f, err := fs.Open(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return procIOBytes{}, err
+	}
+	defer f.Close()
+
+	var io procIOBytes
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "read_bytes:":
+			io.read = v
+		case "write_bytes:":
+			io.write = v
+		}
+	}
+	return io, nil
+}
+
+func countOpenFDs(fs afero.Fs, pid int) (int, error) {
+	entries, err := afero.ReadDir(fs, fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// readCPUTimes reads every "cpu*" line of /proc/stat.
+func readCPUTimes(fs afero.Fs) (map[string]cpuTimes, error) {
+	f, err := fs.Open("/proc/stat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := make(map[string]cpuTimes)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		var vals [8]uint64
+		ok := true
+		for i := 0; i < 8; i++ {
+			v, err := strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				ok = false
+				break
+			}
+			vals[i] = v
+		}
+		if !ok {
+			continue
+		}
+		var total uint64
+		for _, v := range vals {
+			total += v
+		}
+		result[fields[0]] = cpuTimes{total: total, iowait: vals[4], steal: vals[7]}
+	}
+	return result, nil
+}
+
+func cpuDeltas(prev, cur map[string]cpuTimes) []cpuStat {
+	var out []cpuStat
+	for cpu, c := range cur {
+		p, ok := prev[cpu]
+		if !ok {
+			continue
+		}
+		totalDelta := float64(c.total - p.total)
+		if totalDelta <= 0 {
+			out = append(out, cpuStat{CPU: cpu})
+			continue
+		}
+		out = append(out, cpuStat{
+			CPU:           cpu,
+			StealPercent:  100 * float64(c.steal-p.steal) / totalDelta,
+			IowaitPercent: 100 * float64(c.iowait-p.iowait) / totalDelta,
+		})
+	}
+	return out
+}
+
+// sampleOnce gathers a single resourceSample for 'pid'. 'prevCPU', 'prevSysCPU'
+// and 'prevIO' are the previous sample's raw counters, used to compute the
+// process and per-CPU percentages and the IO byte deltas; 'elapsed' is the
+// time since that sample.
+func sampleOnce(
+	fs afero.Fs, pid int, prevCPU procCPUTime, prevSysCPU map[string]cpuTimes, prevIO procIOBytes, elapsed time.Duration,
+) (resourceSample, procCPUTime, map[string]cpuTimes, procIOBytes, error) {
+	cpuTime, err := readProcCPUTime(fs, pid)
+	if err != nil {
+		return resourceSample{}, procCPUTime{}, nil, procIOBytes{}, err
+	}
+
+	sysCPU, err := readCPUTimes(fs)
+	if err != nil {
+		return resourceSample{}, procCPUTime{}, nil, procIOBytes{}, err
+	}
+
+	// /proc/[pid]/io can be unreadable depending on kernel config (e.g.
+	// CONFIG_TASK_IO_ACCOUNTING), so treat it like the other best-effort
+	// fields below and just carry the previous counters forward on error,
+	// rather than aborting the whole sample.
+	io := prevIO
+	if v, err := readProcIOBytes(fs, pid); err == nil {
+		io = v
+	}
+
+	sample := resourceSample{Timestamp: time.Now()}
+
+	if elapsed > 0 {
+		deltaTicks := float64((cpuTime.utime + cpuTime.stime) - (prevCPU.utime + prevCPU.stime))
+		sample.CPUPercent = 100 * (deltaTicks / clockTicksPerSec) / elapsed.Seconds()
+		sample.CPUs = cpuDeltas(prevSysCPU, sysCPU)
+
+		if io.read >= prevIO.read {
+			sample.ReadBytes = io.read - prevIO.read
+		}
+		if io.write >= prevIO.write {
+			sample.WriteBytes = io.write - prevIO.write
+		}
+	}
+
+	if v, err := readProcStatusField(fs, pid, "VmRSS"); err == nil {
+		sample.RSSBytes = v
+	}
+	if v, err := readProcStatusField(fs, pid, "RssAnon"); err == nil {
+		sample.AnonBytes = v
+	}
+	if v, err := readProcStatusField(fs, pid, "RssFile"); err == nil {
+		sample.FileBytes = v
+	}
+	if v, err := readSmapsRollupPSS(fs, pid); err == nil {
+		sample.PSSBytes = v
+	}
+	if v, err := countOpenFDs(fs, pid); err == nil {
+		sample.OpenFDs = v
+	}
+	if v, err := readProcThreads(fs, pid); err == nil {
+		sample.Threads = v
+	}
+
+	return sample, cpuTime, sysCPU, io, nil
+}
+
+// saveResourceUsageData samples the redpanda process's CPU, memory, IO, FD
+// and thread usage at ps.metricsInterval over ps.metricsDuration, writing a
+// JSONL time series to resource-usage.jsonl. It handles the redpanda process
+// disappearing mid-window by stopping early and keeping whatever samples
+// were already collected.
+func saveResourceUsageData(ps *stepParams, conf *config.Config) Step {
+	return func() error {
+		pid, err := findRedpandaPID(ps.fs)
+		if err != nil {
+			return fmt.Errorf("omitting resource usage metrics: %w", err)
+		}
+
+		interval := ps.metricsInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		deadline := time.Now().Add(ps.metricsDuration)
+
+		var (
+			lines      [][]byte
+			prevCPU    procCPUTime
+			prevSysCPU map[string]cpuTimes
+			prevIO     procIOBytes
+			prevTime   time.Time
+		)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for first := true; first || time.Now().Before(deadline); first = false {
+			if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+				log.Debugf("redpanda process %d disappeared mid-sample, stopping early", pid)
+				break
+			}
+
+			var elapsed time.Duration
+			if !prevTime.IsZero() {
+				elapsed = time.Since(prevTime)
+			}
+
+			sample, cpuTime, sysCPU, io, err := sampleOnce(ps.fs, pid, prevCPU, prevSysCPU, prevIO, elapsed)
+			if err != nil {
+				log.Debugf("couldn't read resource usage for pid %d, stopping early: %v", pid, err)
+				break
+			}
+			prevCPU, prevSysCPU, prevIO, prevTime = cpuTime, sysCPU, io, sample.Timestamp
+
+			line, err := json.Marshal(sample)
+			if err != nil {
+				return fmt.Errorf("couldn't encode resource usage sample: %w", err)
+			}
+			lines = append(lines, line)
+
+			if !first && time.Now().After(deadline) {
+				break
+			}
+			<-ticker.C
+		}
+
+		if len(lines) == 0 {
+			return errors.New("omitting resource usage metrics: no samples could be collected")
+		}
+
+		return writeFileToZip(ps, "resource-usage.jsonl", append(bytes.Join(lines, []byte("\n")), '\n'))
+	}
+}
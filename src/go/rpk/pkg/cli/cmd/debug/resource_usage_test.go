@@ -0,0 +1,44 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCPUDeltas(t *testing.T) {
+	prev := map[string]cpuTimes{
+		"cpu0": {total: 1000, iowait: 100, steal: 10},
+		"cpu1": {total: 2000, iowait: 200, steal: 20},
+	}
+	cur := map[string]cpuTimes{
+		"cpu0": {total: 1100, iowait: 150, steal: 15},
+		"cpu1": {total: 2000, iowait: 200, steal: 20}, // no movement
+		"cpu2": {total: 500, iowait: 50, steal: 5},    // wasn't in prev
+	}
+
+	deltas := cpuDeltas(prev, cur)
+
+	byName := make(map[string]cpuStat)
+	for _, d := range deltas {
+		byName[d.CPU] = d
+	}
+
+	require.Len(t, deltas, 2) // cpu2 has no previous sample to diff against
+	require.InDelta(t, 50, byName["cpu0"].IowaitPercent, 0.01)
+	require.InDelta(t, 5, byName["cpu0"].StealPercent, 0.01)
+	require.Zero(t, byName["cpu1"].IowaitPercent)
+	require.Zero(t, byName["cpu1"].StealPercent)
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+// uploadResult is what gets printed to stdout after a successful upload, so
+// that support tooling can parse it out of the command's output.
+type uploadResult struct {
+	URL  string `json:"url"`
+	ETag string `json:"etag,omitempty"`
+}
+
+// uploadBundle streams the bundle at 'path' to 'uploadURL', dispatching on
+// its scheme: s3:// and gs:// shell out to the 'aws' and 'gsutil' CLIs,
+// which pick up credentials the same way they always do (AWS_* env vars or
+// ~/.aws/credentials, and GOOGLE_APPLICATION_CREDENTIALS or 'gcloud auth',
+// respectively); https:// issues a PUT directly, adding 'headers' (e.g. a
+// bearer token) to the request.
+//
+// This shells out rather than linking the AWS/GCS SDKs so that this purely
+// optional convenience doesn't add several megabytes of vendored cloud
+// clients to every rpk binary; it costs requiring 'aws'/'gsutil' on PATH
+// for the s3/gs cases, same as the rest of this package already requires
+// e.g. 'dig', 'ss' or 'crictl' for the collectors that need them.
+func uploadBundle(
+	fs afero.Fs,
+	path, uploadURL string,
+	headers map[string]string,
+	timeout time.Duration,
+) (uploadResult, error) {
+	u, err := url.Parse(uploadURL)
+	if err != nil {
+		return uploadResult{}, fmt.Errorf("couldn't parse --upload-url: %w", err)
+	}
+
+	f, err := fs.Open(path)
+	if err != nil {
+		return uploadResult{}, fmt.Errorf("couldn't open '%s' for upload: %w", path, err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch u.Scheme {
+	case "s3":
+		return uploadToS3(ctx, f, u)
+	case "gs":
+		return uploadToGCS(ctx, f, u)
+	case "https":
+		return uploadToHTTPS(fs, f, path, uploadURL, headers)
+	default:
+		return uploadResult{}, fmt.Errorf("unsupported --upload-url scheme '%s'; expected s3://, gs:// or https://", u.Scheme)
+	}
+}
+
+func uploadToS3(ctx context.Context, body io.Reader, u *url.URL) (uploadResult, error) {
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return uploadResult{}, errors.New("s3 upload URLs must be of the form s3://bucket/key")
+	}
+	dest := fmt.Sprintf("s3://%s/%s", bucket, key)
+
+	cmd := exec.CommandContext(ctx, "aws", "s3", "cp", "-", dest)
+	cmd.Stdin = body
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return uploadResult{}, fmt.Errorf("couldn't upload to '%s' via the aws CLI: %w (%s)", u, err, strings.TrimSpace(stderr.String()))
+	}
+
+	etag, err := exec.CommandContext(
+		ctx, "aws", "s3api", "head-object",
+		"--bucket", bucket, "--key", key,
+		"--query", "ETag", "--output", "text",
+	).Output()
+	if err != nil {
+		log.Debugf("uploaded to '%s' but couldn't fetch its ETag: %v", u, err)
+	}
+
+	return uploadResult{URL: u.String(), ETag: strings.Trim(strings.TrimSpace(string(etag)), `"`)}, nil
+}
+
+func uploadToGCS(ctx context.Context, body io.Reader, u *url.URL) (uploadResult, error) {
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return uploadResult{}, errors.New("gs upload URLs must be of the form gs://bucket/key")
+	}
+	dest := fmt.Sprintf("gs://%s/%s", bucket, key)
+
+	cmd := exec.CommandContext(ctx, "gsutil", "-q", "cp", "-", dest)
+	cmd.Stdin = body
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return uploadResult{}, fmt.Errorf("couldn't upload to '%s' via gsutil: %w (%s)", u, err, strings.TrimSpace(stderr.String()))
+	}
+
+	etag, err := gcsETag(ctx, dest)
+	if err != nil {
+		log.Debugf("uploaded to '%s' but couldn't fetch its ETag: %v", u, err)
+	}
+
+	return uploadResult{URL: u.String(), ETag: etag}, nil
+}
+
+// gcsETag shells out to 'gsutil stat' and scrapes the "ETag:" line out of
+// its human-readable output; gsutil has no machine-readable output mode for
+// 'stat'.
+func gcsETag(ctx context.Context, dest string) (string, error) {
+	out, err := exec.CommandContext(ctx, "gsutil", "stat", dest).Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), "ETag") {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	return "", errors.New("no ETag in 'gsutil stat' output")
+}
+
+func uploadToHTTPS(fs afero.Fs, body io.Reader, path, uploadURL string, headers map[string]string) (uploadResult, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return uploadResult{}, fmt.Errorf("couldn't stat '%s': %w", path, err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, uploadURL, body)
+	if err != nil {
+		return uploadResult{}, err
+	}
+	req.ContentLength = info.Size()
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return uploadResult{}, fmt.Errorf("couldn't upload to '%s': %w", uploadURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return uploadResult{}, fmt.Errorf("upload to '%s' failed with status %s: %s", uploadURL, resp.Status, respBody)
+	}
+
+	return uploadResult{URL: uploadURL, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// parseUploadHeaders turns a list of "key=value" strings, as passed via
+// repeated --upload-header flags, into a header map.
+func parseUploadHeaders(raw []string) (map[string]string, error) {
+	headers := make(map[string]string, len(raw))
+	for _, kv := range raw {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --upload-header '%s'; expected 'key=value'", kv)
+		}
+		headers[parts[0]] = parts[1]
+	}
+	return headers, nil
+}
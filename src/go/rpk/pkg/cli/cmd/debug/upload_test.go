@@ -0,0 +1,58 @@
+// Copyright 2021 Vectorized, Inc.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.md
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0
+
+//go:build linux
+// +build linux
+
+package debug
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUploadHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      []string
+		expected map[string]string
+		errMsg   string
+	}{{
+		name:     "no headers",
+		expected: map[string]string{},
+	}, {
+		name:     "a single header",
+		raw:      []string{"Authorization=Bearer token"},
+		expected: map[string]string{"Authorization": "Bearer token"},
+	}, {
+		name: "multiple headers",
+		raw:  []string{"X-A=1", "X-B=2"},
+		expected: map[string]string{
+			"X-A": "1",
+			"X-B": "2",
+		},
+	}, {
+		name:   "a header missing '='",
+		raw:    []string{"not-a-header"},
+		errMsg: "invalid --upload-header 'not-a-header'; expected 'key=value'",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(st *testing.T) {
+			headers, err := parseUploadHeaders(tt.raw)
+			if tt.errMsg != "" {
+				require.EqualError(st, err, tt.errMsg)
+				return
+			}
+			require.NoError(st, err)
+			require.Equal(st, tt.expected, headers)
+		})
+	}
+}